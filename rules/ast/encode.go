@@ -0,0 +1,171 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ast
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/stats"
+	"github.com/prometheus/prometheus/storage/local"
+)
+
+// EncodeTypedValue writes data's JSON representation to w, in the same
+// envelope TypedValueToJSON builds ({"type":..,"value":..,"version":..}),
+// but streams it series-by-series for a Matrix rather than building the
+// whole result in memory as a string first.
+func EncodeTypedValue(w io.Writer, data interface{}, typeStr string) error {
+	bw := bufio.NewWriter(w)
+
+	if _, err := fmt.Fprintf(bw, `{"type":%q,"value":`, typeStr); err != nil {
+		return err
+	}
+
+	matrix, isMatrix := data.(Matrix)
+	if !isMatrix {
+		if err := encodeJSONValue(bw, data); err != nil {
+			return err
+		}
+	} else {
+		if _, err := bw.WriteString("["); err != nil {
+			return err
+		}
+		for i, sampleStream := range matrix {
+			if i > 0 {
+				if _, err := bw.WriteString(","); err != nil {
+					return err
+				}
+			}
+			if err := encodeJSONValue(bw, sampleStream); err != nil {
+				return err
+			}
+		}
+		if _, err := bw.WriteString("]"); err != nil {
+			return err
+		}
+	}
+
+	if _, err := fmt.Fprintf(bw, `,"version":%d}`, jsonFormatVersion); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// encodeJSONValue writes v's JSON encoding to w with no trailing
+// separator, unlike json.Encoder.Encode, which appends a newline after
+// every value it writes. That newline would otherwise end up embedded in
+// the middle of the envelope EncodeTypedValue is building.
+func encodeJSONValue(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// EvalToWriter evaluates node and streams its representation in the
+// given format to w, instrumented the same way as EvalToStringE. For
+// Text it writes the same rendering EvalToString would return; for JSON
+// it streams through EncodeTypedValue instead of building the whole
+// result as a string first, which matters for large matrix results.
+func EvalToWriter(node Node, timestamp clientmodel.Timestamp, format OutputFormat, w io.Writer, storage local.Storage, queryStats *stats.TimerGroup) error {
+	nodeType := node.Type().String()
+	trackQueryStart()
+	defer trackQueryEnd()
+	defer func() {
+		if r := recover(); r != nil {
+			countQueryError("panic")
+			panic(r)
+		}
+	}()
+
+	totalStart := time.Now()
+	totalEvalTimer := queryStats.GetTimer(stats.TotalEvalTime).Start()
+	defer func() {
+		totalEvalTimer.Stop()
+		observeQueryDuration("total", nodeType, time.Since(totalStart).Seconds())
+	}()
+
+	prepareStart := time.Now()
+	prepareTimer := queryStats.GetTimer(stats.TotalQueryPreparationTime).Start()
+	closer, err := prepareInstantQuery(node, timestamp, storage, queryStats)
+	prepareTimer.Stop()
+	observeQueryDuration("prepare", nodeType, time.Since(prepareStart).Seconds())
+	if err != nil {
+		countQueryError("preparation")
+		return queryErrorWithCause(ErrQueryPreparation, err, node, queryStats)
+	}
+	defer closer.Close()
+
+	evalStart := time.Now()
+	evalTimer := queryStats.GetTimer(stats.InnerEvalTime).Start()
+	switch node.Type() {
+	case ScalarType:
+		scalar := node.(ScalarNode).Eval(timestamp)
+		evalTimer.Stop()
+		observeQueryDuration("inner_eval", nodeType, time.Since(evalStart).Seconds())
+		countQueryResult("scalar")
+		return writeEvalResult(w, format, scalar, "scalar",
+			func() string { return fmt.Sprintf("scalar: %v @[%v]", scalar, timestamp) },
+			func() string { return openMetricsScalar(scalar, timestamp) })
+	case VectorType:
+		vector := node.(VectorNode).Eval(timestamp)
+		evalTimer.Stop()
+		observeQueryDuration("inner_eval", nodeType, time.Since(evalStart).Seconds())
+		countQueryResult("vector")
+		return writeEvalResult(w, format, vector, "vector", vector.String,
+			func() string { return openMetricsVector(vector) })
+	case MatrixType:
+		matrix := node.(MatrixNode).Eval(timestamp)
+		evalTimer.Stop()
+		observeQueryDuration("inner_eval", nodeType, time.Since(evalStart).Seconds())
+		countQueryResult("matrix")
+		return writeEvalResult(w, format, matrix, "matrix", matrix.String,
+			func() string { return openMetricsMatrix(matrix) })
+	case StringType:
+		str := node.(StringNode).Eval(timestamp)
+		evalTimer.Stop()
+		observeQueryDuration("inner_eval", nodeType, time.Since(evalStart).Seconds())
+		countQueryResult("string")
+		return writeEvalResult(w, format, str, "string",
+			func() string { return str },
+			func() string { return openMetricsString(str) })
+	}
+	countQueryError("unknown_node_type")
+	return queryError(ErrUnknownNodeType, node, queryStats)
+}
+
+// writeEvalResult writes a single evaluation result to w in the given
+// format: the string textForm or openMetricsForm renders, for
+// Text/OpenMetrics, or data streamed through EncodeTypedValue for JSON.
+// Only the rendering for the requested format is ever built.
+func writeEvalResult(w io.Writer, format OutputFormat, data interface{}, typeStr string, textForm, openMetricsForm func() string) error {
+	switch format {
+	case Text:
+		_, err := io.WriteString(w, textForm())
+		return err
+	case JSON:
+		return EncodeTypedValue(w, data, typeStr)
+	case OpenMetrics:
+		_, err := io.WriteString(w, openMetricsForm())
+		return err
+	}
+	return fmt.Errorf("unsupported output format for EvalToWriter: %v", format)
+}
@@ -0,0 +1,68 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ast
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+// benchMatrix builds a Matrix with numSeries single-sample series, large
+// enough to make the difference between buffering the whole JSON result
+// and streaming it observable.
+func benchMatrix(numSeries int) Matrix {
+	matrix := make(Matrix, 0, numSeries)
+	for i := 0; i < numSeries; i++ {
+		matrix = append(matrix, &SampleStream{
+			Metric: clientmodel.COWMetric{
+				Metric: clientmodel.Metric{
+					clientmodel.MetricNameLabel: "benchmark_metric",
+					"series":                    clientmodel.LabelValue(fmt.Sprintf("%d", i)),
+				},
+			},
+			Values: []SamplePair{
+				{Value: clientmodel.SampleValue(i), Timestamp: clientmodel.Timestamp(i * 1000)},
+			},
+		})
+	}
+	return matrix
+}
+
+// BenchmarkTypedValueToJSON measures the buffered path: building the
+// whole JSON document in memory before returning it as a string.
+func BenchmarkTypedValueToJSON(b *testing.B) {
+	matrix := benchMatrix(10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = TypedValueToJSON(matrix, "matrix")
+	}
+}
+
+// BenchmarkEncodeTypedValue measures the streaming path for the same
+// matrix, which should show markedly lower peak allocations since it
+// never materializes the full result as a single string.
+func BenchmarkEncodeTypedValue(b *testing.B) {
+	matrix := benchMatrix(10000)
+	var buf bytes.Buffer
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		_ = EncodeTypedValue(&buf, matrix, "matrix")
+	}
+}
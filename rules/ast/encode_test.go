@@ -0,0 +1,95 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ast
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+// wantEnvelope builds the same {"type":...,"value":...,"version":...}
+// JSON TypedValueToJSON is documented to produce, using plain
+// json.Marshal, so it has no way of inheriting json.Encoder's trailing
+// newline bug.
+func wantEnvelope(t *testing.T, data interface{}, typeStr string) string {
+	t.Helper()
+	value, err := json.Marshal(data)
+	if err != nil {
+		t.Fatalf("json.Marshal: %s", err)
+	}
+	envelope := struct {
+		Type    string          `json:"type"`
+		Value   json.RawMessage `json:"value"`
+		Version int             `json:"version"`
+	}{Type: typeStr, Value: value, Version: jsonFormatVersion}
+	want, err := json.Marshal(envelope)
+	if err != nil {
+		t.Fatalf("json.Marshal(envelope): %s", err)
+	}
+	return string(want)
+}
+
+func TestTypedValueToJSONMatchesMarshal(t *testing.T) {
+	vector := Vector{&Sample{
+		Metric: clientmodel.COWMetric{Metric: clientmodel.Metric{
+			clientmodel.MetricNameLabel: "foo",
+		}},
+		Value: 5,
+	}}
+	matrix := Matrix{
+		&SampleStream{
+			Metric: clientmodel.COWMetric{Metric: clientmodel.Metric{
+				clientmodel.MetricNameLabel: "foo",
+			}},
+			Values: []SamplePair{{Value: 1, Timestamp: 0}, {Value: 2, Timestamp: 1000}},
+		},
+		&SampleStream{
+			Metric: clientmodel.COWMetric{Metric: clientmodel.Metric{
+				clientmodel.MetricNameLabel: "bar",
+			}},
+			Values: []SamplePair{{Value: 3, Timestamp: 0}},
+		},
+	}
+
+	cases := []struct {
+		name    string
+		data    interface{}
+		typeStr string
+	}{
+		{"scalar", clientmodel.SampleValue(5), "scalar"},
+		{"vector", vector, "vector"},
+		{"string", "hello", "string"},
+		{"matrix", matrix, "matrix"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			want := wantEnvelope(t, c.data, c.typeStr)
+			if got := TypedValueToJSON(c.data, c.typeStr); got != want {
+				t.Errorf("TypedValueToJSON() = %q, want %q", got, want)
+			}
+
+			var buf bytes.Buffer
+			if err := EncodeTypedValue(&buf, c.data, c.typeStr); err != nil {
+				t.Fatalf("EncodeTypedValue: %s", err)
+			}
+			if got := buf.String(); got != want {
+				t.Errorf("EncodeTypedValue() = %q, want %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ast
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/prometheus/prometheus/stats"
+)
+
+// Sentinel errors returned by EvalToStringE and EvalToVectorE.
+// ErrUnknownNodeType and ErrQueryPreparation come wrapped in a
+// *QueryError, whose Err field embedders can compare against them;
+// EvalToVectorE returns ErrMatrixNotSupported as a plain error.
+var (
+	// ErrMatrixNotSupported is returned when a matrix-typed node is
+	// passed to a function that only supports scalar, vector, and
+	// string results.
+	ErrMatrixNotSupported = errors.New("matrices not supported by this evaluation path")
+	// ErrUnknownNodeType is returned when a node's Type() doesn't match
+	// any of the known node types. It should never happen in practice;
+	// seeing it means the switch in this package fell out of sync with
+	// the node types in rules/ast.
+	ErrUnknownNodeType = errors.New("switch didn't cover all node types")
+	// ErrQueryPreparation is returned when prepareInstantQuery fails,
+	// e.g. because the storage layer could not be queried.
+	ErrQueryPreparation = errors.New("error preparing query")
+)
+
+// QueryError is returned by EvalToStringE and EvalToVectorE when
+// evaluation fails. It carries enough context for an embedder to render
+// a useful diagnostic without reaching into the evaluator's internals.
+type QueryError struct {
+	// Err is one of the sentinel errors above, identifying the kind of
+	// failure.
+	Err error
+	// Node is the String() representation of the node being evaluated
+	// when the failure occurred.
+	Node string
+	// NodeType is the type of Node.
+	NodeType ExprType
+	// Stats holds whatever timers had already been captured before the
+	// failure.
+	Stats *stats.TimerGroup
+
+	cause error
+}
+
+// Error implements the error interface.
+func (e *QueryError) Error() string {
+	if e.cause != nil {
+		return fmt.Sprintf("%s: %s", e.Err, e.cause)
+	}
+	return e.Err.Error()
+}
+
+// queryError builds a *QueryError for node, capturing its rendered form,
+// type, and the stats gathered so far.
+func queryError(err error, node Node, queryStats *stats.TimerGroup) *QueryError {
+	return &QueryError{
+		Err:      err,
+		Node:     node.String(),
+		NodeType: node.Type(),
+		Stats:    queryStats,
+	}
+}
+
+func queryErrorWithCause(err, cause error, node Node, queryStats *stats.TimerGroup) *QueryError {
+	qerr := queryError(err, node, queryStats)
+	qerr.cause = cause
+	return qerr
+}
+
+// errorCode maps a QueryError's sentinel Err to a short machine-readable
+// code, for embedding in ErrorToJSON's output.
+func errorCode(err error) string {
+	switch err {
+	case ErrMatrixNotSupported:
+		return "matrix_not_supported"
+	case ErrUnknownNodeType:
+		return "unknown_node_type"
+	case ErrQueryPreparation:
+		return "query_preparation_failed"
+	default:
+		return "unknown"
+	}
+}
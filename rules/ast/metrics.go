@@ -0,0 +1,118 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ast
+
+import (
+	"expvar"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// This file declares the query-evaluation metrics recorded by printer.go
+// and encode.go, and registers them with both prometheus and expvar.
+
+const (
+	namespace = "prometheus"
+	subsystem = "engine"
+)
+
+var (
+	queryDurations = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "query_duration_seconds",
+			Help:      "The duration of query evaluation, by slice and node type.",
+		},
+		[]string{"slice", "node_type"},
+	)
+	queriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "queries_total",
+			Help:      "The total number of queries evaluated, by result type.",
+		},
+		[]string{"result_type"},
+	)
+	queryErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "query_errors_total",
+			Help:      "The total number of query evaluations that ended in an error or panic, by outcome.",
+		},
+		[]string{"outcome"},
+	)
+	queriesConcurrent = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "queries_concurrent",
+			Help:      "The current number of queries being evaluated.",
+		},
+	)
+)
+
+// expvar mirrors of the above, keyed the same way the Prometheus vectors
+// are labeled.
+var (
+	expvarQueryDurations = expvar.NewMap("prometheusEngineQueryDurationSeconds")
+	expvarQueriesTotal   = expvar.NewMap("prometheusEngineQueriesTotal")
+	expvarQueryErrors    = expvar.NewMap("prometheusEngineQueryErrorsTotal")
+	expvarQueriesCurrent = expvar.NewInt("prometheusEngineQueriesConcurrent")
+)
+
+func init() {
+	prometheus.MustRegister(queryDurations)
+	prometheus.MustRegister(queriesTotal)
+	prometheus.MustRegister(queryErrorsTotal)
+	prometheus.MustRegister(queriesConcurrent)
+}
+
+// observeQueryDuration records seconds spent in the given evaluation
+// slice ("prepare", "inner_eval", or "total") for a node of type
+// nodeType ("scalar", "vector", "matrix", or "string").
+func observeQueryDuration(slice, nodeType string, seconds float64) {
+	queryDurations.WithLabelValues(slice, nodeType).Observe(seconds)
+	expvarQueryDurations.AddFloat(slice+"_"+nodeType, seconds)
+}
+
+// countQueryResult counts one query that completed successfully with the
+// given result type.
+func countQueryResult(resultType string) {
+	queriesTotal.WithLabelValues(resultType).Inc()
+	expvarQueriesTotal.Add(resultType, 1)
+}
+
+// countQueryError counts one query that ended in an error or panic, with
+// outcome describing what went wrong (e.g. "preparation", "panic",
+// "unknown_node_type").
+func countQueryError(outcome string) {
+	queryErrorsTotal.WithLabelValues(outcome).Inc()
+	expvarQueryErrors.Add(outcome, 1)
+}
+
+// trackQueryStart marks the start of a query evaluation.
+func trackQueryStart() {
+	queriesConcurrent.Inc()
+	expvarQueriesCurrent.Add(1)
+}
+
+// trackQueryEnd marks the end of a query evaluation started with
+// trackQueryStart.
+func trackQueryEnd() {
+	queriesConcurrent.Dec()
+	expvarQueriesCurrent.Add(-1)
+}
@@ -0,0 +1,171 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ast
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+// This file renders Vector, Matrix, scalar, and string query results as
+// OpenMetrics text exposition format output.
+
+// openMetricsEscaper escapes the three characters OpenMetrics requires
+// to be escaped inside a label value.
+var openMetricsEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	"\n", `\n`,
+	`"`, `\"`,
+)
+
+// openMetricsTimestamp renders ts as seconds since the epoch with
+// millisecond precision, as OpenMetrics requires.
+func openMetricsTimestamp(ts clientmodel.Timestamp) string {
+	return strconv.FormatFloat(float64(ts)/1000, 'f', 3, 64)
+}
+
+// openMetricsDefaultMetricName is substituted for series that carry no
+// __name__ label, which is the common case for aggregations and
+// arithmetic expressions (sum(...), a + b, ...). OpenMetrics has no
+// concept of an anonymous sample, so every line needs a name.
+const openMetricsDefaultMetricName = "query_result"
+
+// openMetricsMetricName returns metric's __name__ label, or
+// openMetricsDefaultMetricName if it has none.
+func openMetricsMetricName(metric clientmodel.Metric) string {
+	if name, ok := metric[clientmodel.MetricNameLabel]; ok && name != "" {
+		return string(name)
+	}
+	return openMetricsDefaultMetricName
+}
+
+// openMetricsLabels renders metric's labels other than the metric name
+// itself in OpenMetrics' "{k="v",...}" form, prefixed with metricName;
+// metricName alone is returned when there are no other labels.
+func openMetricsLabels(metric clientmodel.Metric, metricName string) string {
+	labelStrings := make([]string, 0, len(metric))
+	for name, value := range metric {
+		if name == clientmodel.MetricNameLabel {
+			continue
+		}
+		labelStrings = append(labelStrings, fmt.Sprintf("%s=\"%s\"", name, openMetricsEscaper.Replace(string(value))))
+	}
+	if len(labelStrings) == 0 {
+		return metricName
+	}
+	sort.Strings(labelStrings)
+	return fmt.Sprintf("%s{%s}", metricName, strings.Join(labelStrings, ","))
+}
+
+// openMetricsScalar renders a scalar result as a synthetic "scalar"
+// gauge metric.
+func openMetricsScalar(value clientmodel.SampleValue, timestamp clientmodel.Timestamp) string {
+	return fmt.Sprintf("# TYPE scalar gauge\nscalar %v %s\n# EOF\n", value, openMetricsTimestamp(timestamp))
+}
+
+// vectorGroup holds the samples of one metric family, in first-seen
+// order, so OpenMetrics' per-family "# TYPE" line only needs to be
+// written once per family with all of its samples directly below it.
+type vectorGroup struct {
+	name    string
+	samples []*Sample
+}
+
+func groupVectorByMetricName(vector Vector) []vectorGroup {
+	groups := make([]vectorGroup, 0, len(vector))
+	indexByName := make(map[string]int, len(vector))
+	for _, sample := range vector {
+		name := openMetricsMetricName(sample.Metric.Metric)
+		i, ok := indexByName[name]
+		if !ok {
+			i = len(groups)
+			indexByName[name] = i
+			groups = append(groups, vectorGroup{name: name})
+		}
+		groups[i].samples = append(groups[i].samples, sample)
+	}
+	return groups
+}
+
+// openMetricsVector renders an instant vector's samples, grouped into
+// one "# TYPE ... gauge" metric family per distinct metric name.
+func openMetricsVector(vector Vector) string {
+	var buf bytes.Buffer
+	for _, group := range groupVectorByMetricName(vector) {
+		fmt.Fprintf(&buf, "# TYPE %s gauge\n", group.name)
+		for _, sample := range group.samples {
+			fmt.Fprintf(&buf, "%s %v %s\n",
+				openMetricsLabels(sample.Metric.Metric, group.name),
+				sample.Value, openMetricsTimestamp(sample.Timestamp))
+		}
+	}
+	buf.WriteString("# EOF\n")
+	return buf.String()
+}
+
+// matrixGroup is vectorGroup's counterpart for range vectors.
+type matrixGroup struct {
+	name          string
+	sampleStreams []*SampleStream
+}
+
+func groupMatrixByMetricName(matrix Matrix) []matrixGroup {
+	groups := make([]matrixGroup, 0, len(matrix))
+	indexByName := make(map[string]int, len(matrix))
+	for _, sampleStream := range matrix {
+		name := openMetricsMetricName(sampleStream.Metric.Metric)
+		i, ok := indexByName[name]
+		if !ok {
+			i = len(groups)
+			indexByName[name] = i
+			groups = append(groups, matrixGroup{name: name})
+		}
+		groups[i].sampleStreams = append(groups[i].sampleStreams, sampleStream)
+	}
+	return groups
+}
+
+// openMetricsMatrix renders a range vector's samples, grouped into one
+// "# TYPE ... gauge" metric family per distinct metric name.
+func openMetricsMatrix(matrix Matrix) string {
+	var buf bytes.Buffer
+	for _, group := range groupMatrixByMetricName(matrix) {
+		fmt.Fprintf(&buf, "# TYPE %s gauge\n", group.name)
+		for _, sampleStream := range group.sampleStreams {
+			labels := openMetricsLabels(sampleStream.Metric.Metric, group.name)
+			for _, value := range sampleStream.Values {
+				fmt.Fprintf(&buf, "%s %v %s\n", labels, value.Value, openMetricsTimestamp(value.Timestamp))
+			}
+		}
+	}
+	buf.WriteString("# EOF\n")
+	return buf.String()
+}
+
+// openMetricsStringMetricName is the synthetic metric name used to carry
+// a string result as an OpenMetrics info series, since OpenMetrics has no
+// native string-valued sample type.
+const openMetricsStringMetricName = "string"
+
+// openMetricsString renders a string result as a "# TYPE ... info" line
+// with the value carried as a label.
+func openMetricsString(value string) string {
+	return fmt.Sprintf("# TYPE %s info\n%s{value=\"%s\"} 1\n# EOF\n",
+		openMetricsStringMetricName, openMetricsStringMetricName, openMetricsEscaper.Replace(value))
+}
@@ -0,0 +1,106 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ast
+
+import (
+	"strings"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+// TestOpenMetricsEscaping guards against a regression where label and
+// string values were escaped twice: once by openMetricsEscaper, then
+// again by %q, which re-escaped the backslashes and quotes the escaper
+// had just produced.
+func TestOpenMetricsEscaping(t *testing.T) {
+	raw := "say \"hi\"\nbye\\now"
+	want := `say \"hi\"\nbye\\now`
+
+	vector := Vector{&Sample{
+		Metric: clientmodel.COWMetric{
+			Metric: clientmodel.Metric{
+				clientmodel.MetricNameLabel: "foo",
+				"label":                     clientmodel.LabelValue(raw),
+			},
+		},
+	}}
+	if out := openMetricsVector(vector); !strings.Contains(out, `label="`+want+`"`) {
+		t.Errorf("openMetricsVector(%q) = %q, want it to contain label=%q", raw, out, want)
+	}
+
+	if out := openMetricsString(raw); !strings.Contains(out, `value="`+want+`"`) {
+		t.Errorf("openMetricsString(%q) = %q, want it to contain value=%q", raw, out, want)
+	}
+}
+
+func TestOpenMetricsVectorTypeLinesAndMetricNameFallback(t *testing.T) {
+	vector := Vector{
+		&Sample{Metric: clientmodel.COWMetric{Metric: clientmodel.Metric{
+			clientmodel.MetricNameLabel: "foo",
+		}}, Value: 1},
+		&Sample{Metric: clientmodel.COWMetric{Metric: clientmodel.Metric{
+			clientmodel.MetricNameLabel: "foo",
+			"job":                       "bar",
+		}}, Value: 2},
+		&Sample{Metric: clientmodel.COWMetric{Metric: clientmodel.Metric{}}, Value: 3},
+	}
+	out := openMetricsVector(vector)
+
+	if n := strings.Count(out, "# TYPE foo gauge\n"); n != 1 {
+		t.Errorf("expected exactly one TYPE line for foo, got %d in %q", n, out)
+	}
+	if !strings.Contains(out, "# TYPE "+openMetricsDefaultMetricName+" gauge\n"+openMetricsDefaultMetricName) {
+		t.Errorf("expected nameless series to fall back to %q, got %q", openMetricsDefaultMetricName, out)
+	}
+	if !strings.HasSuffix(out, "# EOF\n") {
+		t.Errorf("expected output to end with # EOF, got %q", out)
+	}
+}
+
+func TestOpenMetricsMatrixTypeLinesAndMetricNameFallback(t *testing.T) {
+	matrix := Matrix{
+		&SampleStream{
+			Metric: clientmodel.COWMetric{Metric: clientmodel.Metric{
+				clientmodel.MetricNameLabel: "foo",
+			}},
+			Values: []SamplePair{{Value: 1, Timestamp: 0}, {Value: 2, Timestamp: 1000}},
+		},
+		&SampleStream{
+			Metric: clientmodel.COWMetric{Metric: clientmodel.Metric{}},
+			Values: []SamplePair{{Value: 3, Timestamp: 0}},
+		},
+	}
+	out := openMetricsMatrix(matrix)
+
+	if n := strings.Count(out, "# TYPE foo gauge\n"); n != 1 {
+		t.Errorf("expected exactly one TYPE line for foo, got %d in %q", n, out)
+	}
+	if !strings.Contains(out, "# TYPE "+openMetricsDefaultMetricName+" gauge\n"+openMetricsDefaultMetricName) {
+		t.Errorf("expected nameless series to fall back to %q, got %q", openMetricsDefaultMetricName, out)
+	}
+	if !strings.HasSuffix(out, "# EOF\n") {
+		t.Errorf("expected output to end with # EOF, got %q", out)
+	}
+}
+
+func TestOpenMetricsScalar(t *testing.T) {
+	out := openMetricsScalar(5, 1000)
+	if !strings.HasPrefix(out, "# TYPE scalar gauge\nscalar 5 1.000\n") {
+		t.Errorf("openMetricsScalar() = %q, want a TYPE line followed by the sample", out)
+	}
+	if !strings.HasSuffix(out, "# EOF\n") {
+		t.Errorf("expected output to end with # EOF, got %q", out)
+	}
+}
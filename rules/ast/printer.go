@@ -14,18 +14,17 @@
 package ast
 
 import (
+	"bytes"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"reflect"
 	"sort"
 	"strings"
+	"time"
 
 	clientmodel "github.com/prometheus/client_golang/model"
 
 	"github.com/prometheus/prometheus/stats"
 	"github.com/prometheus/prometheus/storage/local"
-	"github.com/prometheus/prometheus/utility"
 )
 
 // OutputFormat is an enum for the possible output formats.
@@ -35,6 +34,7 @@ type OutputFormat int
 const (
 	Text OutputFormat = iota
 	JSON
+	OpenMetrics
 )
 
 const jsonFormatVersion = 1
@@ -120,18 +120,29 @@ func (matrix Matrix) String() string {
 	return strings.Join(metricStrings, "\n")
 }
 
-// ErrorToJSON converts the given error into JSON.
+// ErrorToJSON converts the given error into JSON. If err is a
+// *QueryError, the code, nodeType, and position (the offending node's
+// String()) are included alongside the usual value.
 func ErrorToJSON(err error) string {
 	errorStruct := struct {
-		Type    string `json:"type"`
-		Value   string `json:"value"`
-		Version int    `json:"version"`
+		Type     string `json:"type"`
+		Value    string `json:"value"`
+		Version  int    `json:"version"`
+		Code     string `json:"code,omitempty"`
+		NodeType string `json:"nodeType,omitempty"`
+		Position string `json:"position,omitempty"`
 	}{
 		Type:    "error",
 		Value:   err.Error(),
 		Version: jsonFormatVersion,
 	}
 
+	if qerr, ok := err.(*QueryError); ok {
+		errorStruct.Code = errorCode(qerr.Err)
+		errorStruct.NodeType = qerr.NodeType.String()
+		errorStruct.Position = qerr.Node
+	}
+
 	errorJSON, err := json.Marshal(errorStruct)
 	if err != nil {
 		return ""
@@ -139,108 +150,193 @@ func ErrorToJSON(err error) string {
 	return string(errorJSON)
 }
 
-// TypedValueToJSON converts the given data of type 'scalar',
-// 'vector', or 'matrix' into its JSON representation.
+// TypedValueToJSON converts the given data of type 'scalar', 'vector', or
+// 'matrix' into its JSON representation. It is a thin wrapper around
+// EncodeTypedValue for callers that want a string; EncodeTypedValue
+// itself streams and should be preferred for large matrices.
 func TypedValueToJSON(data interface{}, typeStr string) string {
-	dataStruct := struct {
-		Type    string      `json:"type"`
-		Value   interface{} `json:"value"`
-		Version int         `json:"version"`
-	}{
-		Type:    typeStr,
-		Value:   data,
-		Version: jsonFormatVersion,
-	}
-	dataJSON, err := json.Marshal(dataStruct)
-	if err != nil {
+	var buf bytes.Buffer
+	if err := EncodeTypedValue(&buf, data, typeStr); err != nil {
 		return ErrorToJSON(err)
 	}
-	return string(dataJSON)
+	return buf.String()
 }
 
-// EvalToString evaluates the given node into a string of the given format.
+// EvalToString evaluates the given node into a string of the given
+// format. It panics on preparation failure or an unrecognized node type;
+// embedders that can't tolerate a panic should use EvalToStringE instead.
 func EvalToString(node Node, timestamp clientmodel.Timestamp, format OutputFormat, storage local.Storage, queryStats *stats.TimerGroup) string {
+	str, err := EvalToStringE(node, timestamp, format, storage, queryStats)
+	if err != nil {
+		panic(err)
+	}
+	return str
+}
+
+// EvalToStringE evaluates the given node into a string of the given
+// format, like EvalToString, but returns a *QueryError instead of
+// panicking on preparation failure or an unrecognized node type.
+func EvalToStringE(node Node, timestamp clientmodel.Timestamp, format OutputFormat, storage local.Storage, queryStats *stats.TimerGroup) (string, error) {
+	nodeType := node.Type().String()
+	trackQueryStart()
+	defer trackQueryEnd()
+	defer func() {
+		if r := recover(); r != nil {
+			countQueryError("panic")
+			panic(r)
+		}
+	}()
+
+	totalStart := time.Now()
 	totalEvalTimer := queryStats.GetTimer(stats.TotalEvalTime).Start()
-	defer totalEvalTimer.Stop()
+	defer func() {
+		totalEvalTimer.Stop()
+		observeQueryDuration("total", nodeType, time.Since(totalStart).Seconds())
+	}()
 
+	prepareStart := time.Now()
 	prepareTimer := queryStats.GetTimer(stats.TotalQueryPreparationTime).Start()
 	closer, err := prepareInstantQuery(node, timestamp, storage, queryStats)
 	prepareTimer.Stop()
+	observeQueryDuration("prepare", nodeType, time.Since(prepareStart).Seconds())
 	if err != nil {
-		panic(err)
+		countQueryError("preparation")
+		return "", queryErrorWithCause(ErrQueryPreparation, err, node, queryStats)
 	}
 	defer closer.Close()
 
+	evalStart := time.Now()
 	evalTimer := queryStats.GetTimer(stats.InnerEvalTime).Start()
 	switch node.Type() {
 	case ScalarType:
 		scalar := node.(ScalarNode).Eval(timestamp)
 		evalTimer.Stop()
+		observeQueryDuration("inner_eval", nodeType, time.Since(evalStart).Seconds())
+		countQueryResult("scalar")
 		switch format {
 		case Text:
-			return fmt.Sprintf("scalar: %v @[%v]", scalar, timestamp)
+			return fmt.Sprintf("scalar: %v @[%v]", scalar, timestamp), nil
 		case JSON:
-			return TypedValueToJSON(scalar, "scalar")
+			return TypedValueToJSON(scalar, "scalar"), nil
+		case OpenMetrics:
+			return openMetricsScalar(scalar, timestamp), nil
 		}
 	case VectorType:
 		vector := node.(VectorNode).Eval(timestamp)
 		evalTimer.Stop()
+		observeQueryDuration("inner_eval", nodeType, time.Since(evalStart).Seconds())
+		countQueryResult("vector")
 		switch format {
 		case Text:
-			return vector.String()
+			return vector.String(), nil
 		case JSON:
-			return TypedValueToJSON(vector, "vector")
+			return TypedValueToJSON(vector, "vector"), nil
+		case OpenMetrics:
+			return openMetricsVector(vector), nil
 		}
 	case MatrixType:
 		matrix := node.(MatrixNode).Eval(timestamp)
 		evalTimer.Stop()
+		observeQueryDuration("inner_eval", nodeType, time.Since(evalStart).Seconds())
+		countQueryResult("matrix")
 		switch format {
 		case Text:
-			return matrix.String()
+			return matrix.String(), nil
 		case JSON:
-			return TypedValueToJSON(matrix, "matrix")
+			return TypedValueToJSON(matrix, "matrix"), nil
+		case OpenMetrics:
+			return openMetricsMatrix(matrix), nil
 		}
 	case StringType:
 		str := node.(StringNode).Eval(timestamp)
 		evalTimer.Stop()
+		observeQueryDuration("inner_eval", nodeType, time.Since(evalStart).Seconds())
+		countQueryResult("string")
 		switch format {
 		case Text:
-			return str
+			return str, nil
 		case JSON:
-			return TypedValueToJSON(str, "string")
+			return TypedValueToJSON(str, "string"), nil
+		case OpenMetrics:
+			return openMetricsString(str), nil
 		}
 	}
-	panic("Switch didn't cover all node types")
+	countQueryError("unknown_node_type")
+	return "", queryError(ErrUnknownNodeType, node, queryStats)
 }
 
-// EvalToVector evaluates the given node into a Vector. Matrices aren't supported.
+// EvalToVector evaluates the given node into a Vector. Matrices aren't
+// supported. It panics on preparation failure or an unrecognized node
+// type; embedders that can't tolerate a panic should use EvalToVectorE
+// instead.
 func EvalToVector(node Node, timestamp clientmodel.Timestamp, storage local.Storage, queryStats *stats.TimerGroup) (Vector, error) {
+	vector, err := EvalToVectorE(node, timestamp, storage, queryStats)
+	if err != nil {
+		if _, ok := err.(*QueryError); !ok {
+			return nil, err
+		}
+		panic(err)
+	}
+	return vector, nil
+}
+
+// EvalToVectorE evaluates the given node into a Vector, like
+// EvalToVector, but returns a *QueryError instead of panicking on
+// preparation failure or an unrecognized node type. A matrix-typed node
+// still returns ErrMatrixNotSupported as a plain error, as EvalToVector
+// always has.
+func EvalToVectorE(node Node, timestamp clientmodel.Timestamp, storage local.Storage, queryStats *stats.TimerGroup) (Vector, error) {
+	nodeType := node.Type().String()
+	trackQueryStart()
+	defer trackQueryEnd()
+	defer func() {
+		if r := recover(); r != nil {
+			countQueryError("panic")
+			panic(r)
+		}
+	}()
+
+	totalStart := time.Now()
 	totalEvalTimer := queryStats.GetTimer(stats.TotalEvalTime).Start()
-	defer totalEvalTimer.Stop()
+	defer func() {
+		totalEvalTimer.Stop()
+		observeQueryDuration("total", nodeType, time.Since(totalStart).Seconds())
+	}()
 
+	prepareStart := time.Now()
 	prepareTimer := queryStats.GetTimer(stats.TotalQueryPreparationTime).Start()
 	closer, err := prepareInstantQuery(node, timestamp, storage, queryStats)
 	prepareTimer.Stop()
+	observeQueryDuration("prepare", nodeType, time.Since(prepareStart).Seconds())
 	if err != nil {
-		panic(err)
+		countQueryError("preparation")
+		return nil, queryErrorWithCause(ErrQueryPreparation, err, node, queryStats)
 	}
 	defer closer.Close()
 
+	evalStart := time.Now()
 	evalTimer := queryStats.GetTimer(stats.InnerEvalTime).Start()
 	switch node.Type() {
 	case ScalarType:
 		scalar := node.(ScalarNode).Eval(timestamp)
 		evalTimer.Stop()
+		observeQueryDuration("inner_eval", nodeType, time.Since(evalStart).Seconds())
+		countQueryResult("scalar")
 		return Vector{&Sample{Value: scalar}}, nil
 	case VectorType:
 		vector := node.(VectorNode).Eval(timestamp)
 		evalTimer.Stop()
+		observeQueryDuration("inner_eval", nodeType, time.Since(evalStart).Seconds())
+		countQueryResult("vector")
 		return vector, nil
 	case MatrixType:
-		return nil, errors.New("matrices not supported by EvalToVector")
+		countQueryError("matrix_not_supported")
+		return nil, ErrMatrixNotSupported
 	case StringType:
 		str := node.(StringNode).Eval(timestamp)
 		evalTimer.Stop()
+		observeQueryDuration("inner_eval", nodeType, time.Since(evalStart).Seconds())
+		countQueryResult("string")
 		return Vector{
 			&Sample{
 				Metric: clientmodel.COWMetric{
@@ -252,123 +348,44 @@ func EvalToVector(node Node, timestamp clientmodel.Timestamp, storage local.Stor
 			},
 		}, nil
 	}
-	panic("Switch didn't cover all node types")
+	countQueryError("unknown_node_type")
+	return nil, queryError(ErrUnknownNodeType, node, queryStats)
 }
 
-// NodeTreeToDotGraph returns a DOT representation of the scalar
-// literal.
-func (node *ScalarLiteral) NodeTreeToDotGraph() string {
-	return fmt.Sprintf("%#p[label=\"%v\"];\n", node, node.value)
-}
+// NodeTreeToDotGraph returns a DOT representation of the AST rooted at
+// node. The label and edge layout for each concrete node type live in
+// the dotGraphVisitor in visitors.go; these methods just delegate into
+// it so every node continues to satisfy the same interface.
 
-func functionArgsToDotGraph(node Node, args []Node) string {
-	graph := ""
-	for _, arg := range args {
-		graph += fmt.Sprintf("%x -> %x;\n", reflect.ValueOf(node).Pointer(), reflect.ValueOf(arg).Pointer())
-	}
-	for _, arg := range args {
-		graph += arg.NodeTreeToDotGraph()
-	}
-	return graph
-}
+// NodeTreeToDotGraph returns a DOT representation of the scalar literal.
+func (node *ScalarLiteral) NodeTreeToDotGraph() string { return nodeTreeToDotGraph(node) }
 
-// NodeTreeToDotGraph returns a DOT representation of the function
-// call.
-func (node *ScalarFunctionCall) NodeTreeToDotGraph() string {
-	graph := fmt.Sprintf("%#p[label=\"%s\"];\n", node, node.function.name)
-	graph += functionArgsToDotGraph(node, node.args)
-	return graph
-}
+// NodeTreeToDotGraph returns a DOT representation of the function call.
+func (node *ScalarFunctionCall) NodeTreeToDotGraph() string { return nodeTreeToDotGraph(node) }
 
 // NodeTreeToDotGraph returns a DOT representation of the expression.
-func (node *ScalarArithExpr) NodeTreeToDotGraph() string {
-	nodeAddr := reflect.ValueOf(node).Pointer()
-	graph := fmt.Sprintf(
-		`
-		%x[label="%s"];
-		%x -> %x;
-		%x -> %x;
-		%s
-		%s
-	}`,
-		nodeAddr, node.opType,
-		nodeAddr, reflect.ValueOf(node.lhs).Pointer(),
-		nodeAddr, reflect.ValueOf(node.rhs).Pointer(),
-		node.lhs.NodeTreeToDotGraph(),
-		node.rhs.NodeTreeToDotGraph(),
-	)
-	return graph
-}
+func (node *ScalarArithExpr) NodeTreeToDotGraph() string { return nodeTreeToDotGraph(node) }
 
 // NodeTreeToDotGraph returns a DOT representation of the vector selector.
-func (node *VectorSelector) NodeTreeToDotGraph() string {
-	return fmt.Sprintf("%#p[label=\"%s\"];\n", node, node)
-}
+func (node *VectorSelector) NodeTreeToDotGraph() string { return nodeTreeToDotGraph(node) }
 
-// NodeTreeToDotGraph returns a DOT representation of the function
-// call.
-func (node *VectorFunctionCall) NodeTreeToDotGraph() string {
-	graph := fmt.Sprintf("%#p[label=\"%s\"];\n", node, node.function.name)
-	graph += functionArgsToDotGraph(node, node.args)
-	return graph
-}
+// NodeTreeToDotGraph returns a DOT representation of the function call.
+func (node *VectorFunctionCall) NodeTreeToDotGraph() string { return nodeTreeToDotGraph(node) }
 
-// NodeTreeToDotGraph returns a DOT representation of the vector
-// aggregation.
-func (node *VectorAggregation) NodeTreeToDotGraph() string {
-	groupByStrings := make([]string, 0, len(node.groupBy))
-	for _, label := range node.groupBy {
-		groupByStrings = append(groupByStrings, string(label))
-	}
-
-	graph := fmt.Sprintf("%#p[label=\"%s BY (%s)\"]\n",
-		node,
-		node.aggrType,
-		strings.Join(groupByStrings, ", "))
-	graph += fmt.Sprintf("%#p -> %x;\n", node, reflect.ValueOf(node.vector).Pointer())
-	graph += node.vector.NodeTreeToDotGraph()
-	return graph
-}
+// NodeTreeToDotGraph returns a DOT representation of the vector aggregation.
+func (node *VectorAggregation) NodeTreeToDotGraph() string { return nodeTreeToDotGraph(node) }
 
 // NodeTreeToDotGraph returns a DOT representation of the expression.
-func (node *VectorArithExpr) NodeTreeToDotGraph() string {
-	nodeAddr := reflect.ValueOf(node).Pointer()
-	graph := fmt.Sprintf(
-		`
-		%x[label="%s"];
-		%x -> %x;
-		%x -> %x;
-		%s
-		%s
-	}`,
-		nodeAddr, node.opType,
-		nodeAddr, reflect.ValueOf(node.lhs).Pointer(),
-		nodeAddr, reflect.ValueOf(node.rhs).Pointer(),
-		node.lhs.NodeTreeToDotGraph(),
-		node.rhs.NodeTreeToDotGraph(),
-	)
-	return graph
-}
+func (node *VectorArithExpr) NodeTreeToDotGraph() string { return nodeTreeToDotGraph(node) }
 
-// NodeTreeToDotGraph returns a DOT representation of the matrix
-// selector.
-func (node *MatrixSelector) NodeTreeToDotGraph() string {
-	return fmt.Sprintf("%#p[label=\"%s\"];\n", node, node)
-}
+// NodeTreeToDotGraph returns a DOT representation of the matrix selector.
+func (node *MatrixSelector) NodeTreeToDotGraph() string { return nodeTreeToDotGraph(node) }
 
-// NodeTreeToDotGraph returns a DOT representation of the string
-// literal.
-func (node *StringLiteral) NodeTreeToDotGraph() string {
-	return fmt.Sprintf("%#p[label=\"'%q'\"];\n", node, node.str)
-}
+// NodeTreeToDotGraph returns a DOT representation of the string literal.
+func (node *StringLiteral) NodeTreeToDotGraph() string { return nodeTreeToDotGraph(node) }
 
-// NodeTreeToDotGraph returns a DOT representation of the function
-// call.
-func (node *StringFunctionCall) NodeTreeToDotGraph() string {
-	graph := fmt.Sprintf("%#p[label=\"%s\"];\n", node, node.function.name)
-	graph += functionArgsToDotGraph(node, node.args)
-	return graph
-}
+// NodeTreeToDotGraph returns a DOT representation of the function call.
+func (node *StringFunctionCall) NodeTreeToDotGraph() string { return nodeTreeToDotGraph(node) }
 
 func (nodes Nodes) String() string {
 	nodeStrings := make([]string, 0, len(nodes))
@@ -378,64 +395,16 @@ func (nodes Nodes) String() string {
 	return strings.Join(nodeStrings, ", ")
 }
 
-func (node *ScalarLiteral) String() string {
-	return fmt.Sprint(node.value)
-}
-
-func (node *ScalarFunctionCall) String() string {
-	return fmt.Sprintf("%s(%s)", node.function.name, node.args)
-}
-
-func (node *ScalarArithExpr) String() string {
-	return fmt.Sprintf("(%s %s %s)", node.lhs, node.opType, node.rhs)
-}
-
-func (node *VectorSelector) String() string {
-	labelStrings := make([]string, 0, len(node.labelMatchers)-1)
-	var metricName clientmodel.LabelValue
-	for _, matcher := range node.labelMatchers {
-		if matcher.Name != clientmodel.MetricNameLabel {
-			labelStrings = append(labelStrings, fmt.Sprintf("%s%s%q", matcher.Name, matcher.Type, matcher.Value))
-		} else {
-			metricName = matcher.Value
-		}
-	}
-
-	switch len(labelStrings) {
-	case 0:
-		return string(metricName)
-	default:
-		sort.Strings(labelStrings)
-		return fmt.Sprintf("%s{%s}", metricName, strings.Join(labelStrings, ","))
-	}
-}
-
-func (node *VectorFunctionCall) String() string {
-	return fmt.Sprintf("%s(%s)", node.function.name, node.args)
-}
-
-func (node *VectorAggregation) String() string {
-	aggrString := fmt.Sprintf("%s(%s)", node.aggrType, node.vector)
-	if len(node.groupBy) > 0 {
-		return fmt.Sprintf("%s BY (%s)", aggrString, node.groupBy)
-	}
-	return aggrString
-}
-
-func (node *VectorArithExpr) String() string {
-	return fmt.Sprintf("(%s %s %s)", node.lhs, node.opType, node.rhs)
-}
-
-func (node *MatrixSelector) String() string {
-	vectorString := (&VectorSelector{labelMatchers: node.labelMatchers}).String()
-	intervalString := fmt.Sprintf("[%s]", utility.DurationToString(node.interval))
-	return vectorString + intervalString
-}
-
-func (node *StringLiteral) String() string {
-	return fmt.Sprintf("%q", node.str)
-}
-
-func (node *StringFunctionCall) String() string {
-	return fmt.Sprintf("%s(%s)", node.function.name, node.args)
-}
+// String renders node back into PromQL-like surface syntax. Every
+// concrete type delegates into the shared stringVisitor in visitors.go.
+
+func (node *ScalarLiteral) String() string      { return renderNode(node) }
+func (node *ScalarFunctionCall) String() string { return renderNode(node) }
+func (node *ScalarArithExpr) String() string    { return renderNode(node) }
+func (node *VectorSelector) String() string     { return renderNode(node) }
+func (node *VectorFunctionCall) String() string { return renderNode(node) }
+func (node *VectorAggregation) String() string  { return renderNode(node) }
+func (node *VectorArithExpr) String() string    { return renderNode(node) }
+func (node *MatrixSelector) String() string     { return renderNode(node) }
+func (node *StringLiteral) String() string      { return renderNode(node) }
+func (node *StringFunctionCall) String() string { return renderNode(node) }
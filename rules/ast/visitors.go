@@ -0,0 +1,241 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ast
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/utility"
+)
+
+// This file holds the Visitor-based implementations backing every
+// concrete node's String and NodeTreeToDotGraph methods, plus jsonNode's
+// traversal for NodeToJSON. dotGraphVisitor and newJSONNode walk the
+// Children relation in walk.go, while stringVisitor recurses through each
+// node's fields itself, so a new node type has to be added to the type
+// switches here and in Children rather than growing a method on every
+// node.
+
+// stringVisitor renders a node and its descendants into PromQL-like
+// surface syntax. Unlike dotGraphVisitor it recurses itself (via nested
+// calls to Walk) rather than relying on Walk's automatic recursion,
+// because the surface syntax needs operators and parentheses interleaved
+// between children, not just a flat visit of each one.
+type stringVisitor struct {
+	buf bytes.Buffer
+}
+
+func (v *stringVisitor) Visit(node Node) (Visitor, bool) {
+	switch n := node.(type) {
+	case *ScalarLiteral:
+		fmt.Fprint(&v.buf, n.value)
+	case *ScalarFunctionCall:
+		v.visitCall(n.function.name, n.args)
+	case *ScalarArithExpr:
+		v.visitArithExpr(n.lhs, n.opType, n.rhs)
+	case *VectorSelector:
+		v.buf.WriteString(vectorSelectorString(n))
+	case *VectorFunctionCall:
+		v.visitCall(n.function.name, n.args)
+	case *VectorAggregation:
+		v.visitAggregation(n)
+	case *VectorArithExpr:
+		v.visitArithExpr(n.lhs, n.opType, n.rhs)
+	case *MatrixSelector:
+		v.buf.WriteString(vectorSelectorString(&VectorSelector{labelMatchers: n.labelMatchers}))
+		fmt.Fprintf(&v.buf, "[%s]", utility.DurationToString(n.interval))
+	case *StringLiteral:
+		fmt.Fprintf(&v.buf, "%q", n.str)
+	case *StringFunctionCall:
+		v.visitCall(n.function.name, n.args)
+	default:
+		panic(fmt.Sprintf("ast.stringVisitor: unexpected node type %T", n))
+	}
+	return nil, false
+}
+
+func (v *stringVisitor) visitCall(name string, args Nodes) {
+	v.buf.WriteString(name)
+	v.buf.WriteString("(")
+	for i, arg := range args {
+		if i > 0 {
+			v.buf.WriteString(", ")
+		}
+		Walk(v, arg)
+	}
+	v.buf.WriteString(")")
+}
+
+func (v *stringVisitor) visitArithExpr(lhs Node, opType BinOpType, rhs Node) {
+	v.buf.WriteString("(")
+	Walk(v, lhs)
+	fmt.Fprintf(&v.buf, " %s ", opType)
+	Walk(v, rhs)
+	v.buf.WriteString(")")
+}
+
+func (v *stringVisitor) visitAggregation(n *VectorAggregation) {
+	fmt.Fprintf(&v.buf, "%s(", n.aggrType)
+	Walk(v, n.vector)
+	v.buf.WriteString(")")
+	if len(n.groupBy) > 0 {
+		groupByStrings := make([]string, 0, len(n.groupBy))
+		for _, label := range n.groupBy {
+			groupByStrings = append(groupByStrings, string(label))
+		}
+		fmt.Fprintf(&v.buf, " BY (%s)", strings.Join(groupByStrings, ", "))
+	}
+}
+
+// vectorSelectorString renders a vector selector's metric name and label
+// matchers; it is also reused by matrix selectors, which share the same
+// label matcher syntax.
+func vectorSelectorString(node *VectorSelector) string {
+	labelStrings := make([]string, 0, len(node.labelMatchers))
+	var metricName clientmodel.LabelValue
+	for _, matcher := range node.labelMatchers {
+		if matcher.Name != clientmodel.MetricNameLabel {
+			labelStrings = append(labelStrings, fmt.Sprintf("%s%s%q", matcher.Name, matcher.Type, matcher.Value))
+		} else {
+			metricName = matcher.Value
+		}
+	}
+
+	switch len(labelStrings) {
+	case 0:
+		return string(metricName)
+	default:
+		sort.Strings(labelStrings)
+		return fmt.Sprintf("%s{%s}", metricName, strings.Join(labelStrings, ","))
+	}
+}
+
+// renderNode is the shared implementation behind every concrete node's
+// String method.
+func renderNode(node Node) string {
+	v := &stringVisitor{}
+	Walk(v, node)
+	return v.buf.String()
+}
+
+// dotGraphVisitor builds a DOT representation of a node tree. Unlike
+// stringVisitor it lets Walk do the recursion: it writes node's own label
+// and the edges to its children, then returns (v, true) so Walk descends
+// into each child next, emitting that child's label and edges in turn.
+type dotGraphVisitor struct {
+	buf bytes.Buffer
+}
+
+func (v *dotGraphVisitor) Visit(node Node) (Visitor, bool) {
+	v.buf.WriteString(dotNodeLabel(node))
+	nodeAddr := reflect.ValueOf(node).Pointer()
+	for _, child := range Children(node) {
+		fmt.Fprintf(&v.buf, "%x -> %x;\n", nodeAddr, reflect.ValueOf(child).Pointer())
+	}
+	return v, true
+}
+
+// dotNodeLabel returns the DOT "label" statement for a single node,
+// without its outgoing edges.
+func dotNodeLabel(node Node) string {
+	switch n := node.(type) {
+	case *ScalarLiteral:
+		return fmt.Sprintf("%#p[label=\"%v\"];\n", n, n.value)
+	case *ScalarFunctionCall:
+		return fmt.Sprintf("%#p[label=\"%s\"];\n", n, n.function.name)
+	case *ScalarArithExpr:
+		return fmt.Sprintf("%#p[label=\"%s\"];\n", n, n.opType)
+	case *VectorSelector:
+		return fmt.Sprintf("%#p[label=\"%s\"];\n", n, n)
+	case *VectorFunctionCall:
+		return fmt.Sprintf("%#p[label=\"%s\"];\n", n, n.function.name)
+	case *VectorAggregation:
+		groupByStrings := make([]string, 0, len(n.groupBy))
+		for _, label := range n.groupBy {
+			groupByStrings = append(groupByStrings, string(label))
+		}
+		return fmt.Sprintf("%#p[label=\"%s BY (%s)\"];\n", n, n.aggrType, strings.Join(groupByStrings, ", "))
+	case *VectorArithExpr:
+		return fmt.Sprintf("%#p[label=\"%s\"];\n", n, n.opType)
+	case *MatrixSelector:
+		return fmt.Sprintf("%#p[label=\"%s\"];\n", n, n)
+	case *StringLiteral:
+		return fmt.Sprintf("%#p[label=\"'%q'\"];\n", n, n.str)
+	case *StringFunctionCall:
+		return fmt.Sprintf("%#p[label=\"%s\"];\n", n, n.function.name)
+	}
+	panic(fmt.Sprintf("ast.dotNodeLabel: unexpected node type %T", node))
+}
+
+// nodeTreeToDotGraph is the shared implementation behind every concrete
+// node's NodeTreeToDotGraph method.
+func nodeTreeToDotGraph(node Node) string {
+	v := &dotGraphVisitor{}
+	Walk(v, node)
+	return v.buf.String()
+}
+
+// jsonNode is the canonical JSON representation of an AST node, keyed by
+// concrete node type. It is built directly on top of Children rather
+// than a Visitor, since it needs to return a value (not just traverse),
+// but it is this same Children relation that makes Walk/Visit work.
+// It's intended as a normalized form for things like query cache keys,
+// where two structurally identical queries should hash the same.
+type jsonNode struct {
+	Type     string      `json:"type"`
+	Value    interface{} `json:"value,omitempty"`
+	Children []jsonNode  `json:"children,omitempty"`
+}
+
+func newJSONNode(node Node) jsonNode {
+	jn := jsonNode{Type: fmt.Sprintf("%T", node)}
+	switch n := node.(type) {
+	case *ScalarLiteral:
+		jn.Value = n.value
+	case *ScalarFunctionCall:
+		jn.Value = n.function.name
+	case *ScalarArithExpr:
+		jn.Value = n.opType.String()
+	case *VectorSelector:
+		jn.Value = n.String()
+	case *VectorFunctionCall:
+		jn.Value = n.function.name
+	case *VectorAggregation:
+		jn.Value = n.aggrType.String()
+	case *VectorArithExpr:
+		jn.Value = n.opType.String()
+	case *MatrixSelector:
+		jn.Value = n.String()
+	case *StringLiteral:
+		jn.Value = n.str
+	case *StringFunctionCall:
+		jn.Value = n.function.name
+	}
+	for _, child := range Children(node) {
+		jn.Children = append(jn.Children, newJSONNode(child))
+	}
+	return jn
+}
+
+// NodeToJSON serializes node's AST into a canonical JSON form.
+func NodeToJSON(node Node) ([]byte, error) {
+	return json.Marshal(newJSONNode(node))
+}
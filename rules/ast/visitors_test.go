@@ -0,0 +1,71 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ast
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRenderNodeScalarArithExpr(t *testing.T) {
+	node := &ScalarArithExpr{
+		lhs:    &ScalarLiteral{value: 1},
+		opType: Add,
+		rhs:    &ScalarLiteral{value: 2},
+	}
+	if got, want := node.String(), "(1 + 2)"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestNodeTreeToDotGraphScalarLiteral(t *testing.T) {
+	node := &ScalarLiteral{value: 42}
+	if graph := node.NodeTreeToDotGraph(); !strings.Contains(graph, "42") {
+		t.Errorf("NodeTreeToDotGraph() = %q, want it to mention the literal value", graph)
+	}
+}
+
+// TestNodeToJSONDistinguishesFunctionCalls guards against a regression
+// where newJSONNode had no case for *VectorFunctionCall (or the other
+// function call node types): every call serialized to the same JSON
+// regardless of which function it invoked, so structurally different
+// queries like sum(...) and rate(...) would collide as the same cache
+// key.
+func TestNodeToJSONDistinguishesFunctionCalls(t *testing.T) {
+	sumNode := &VectorFunctionCall{function: &Function{name: "sum"}, args: Nodes{&VectorSelector{}}}
+	rateNode := &VectorFunctionCall{function: &Function{name: "rate"}, args: Nodes{&VectorSelector{}}}
+
+	sumJSON, err := NodeToJSON(sumNode)
+	if err != nil {
+		t.Fatalf("NodeToJSON(sum): %s", err)
+	}
+	rateJSON, err := NodeToJSON(rateNode)
+	if err != nil {
+		t.Fatalf("NodeToJSON(rate): %s", err)
+	}
+	if string(sumJSON) == string(rateJSON) {
+		t.Fatalf("sum(...) and rate(...) serialized identically: %s", sumJSON)
+	}
+
+	var decoded struct {
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal(sumJSON, &decoded); err != nil {
+		t.Fatalf("unmarshal: %s", err)
+	}
+	if decoded.Value != "sum" {
+		t.Errorf("decoded.Value = %q, want %q", decoded.Value, "sum")
+	}
+}
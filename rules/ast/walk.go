@@ -0,0 +1,97 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ast
+
+import "fmt"
+
+// A Visitor's Visit method is invoked for each node encountered by Walk.
+// If the returned Visitor w is non-nil and keepGoing is true, Walk visits
+// each of the children of node with the visitor w.
+type Visitor interface {
+	Visit(node Node) (w Visitor, keepGoing bool)
+}
+
+// Walk traverses an AST in depth-first order: it calls v.Visit(node). If
+// the visitor w returned by v.Visit(node) is non-nil and keepGoing is
+// true, Walk is invoked recursively with visitor w for each of the
+// children of node.
+func Walk(v Visitor, node Node) {
+	w, keepGoing := v.Visit(node)
+	if w == nil || !keepGoing {
+		return
+	}
+	for _, child := range Children(node) {
+		Walk(w, child)
+	}
+}
+
+// Children returns the child nodes of node, i.e. the sub-expressions it
+// was built from. Leaf nodes (literals and selectors) have no children.
+func Children(node Node) Nodes {
+	switch n := node.(type) {
+	case *ScalarLiteral:
+		return nil
+	case *ScalarFunctionCall:
+		return n.args
+	case *ScalarArithExpr:
+		return Nodes{n.lhs, n.rhs}
+	case *VectorSelector:
+		return nil
+	case *VectorFunctionCall:
+		return n.args
+	case *VectorAggregation:
+		return Nodes{n.vector}
+	case *VectorArithExpr:
+		return Nodes{n.lhs, n.rhs}
+	case *MatrixSelector:
+		return nil
+	case *StringLiteral:
+		return nil
+	case *StringFunctionCall:
+		return n.args
+	}
+	panic(fmt.Sprintf("ast.Children: unexpected node type %T", node))
+}
+
+// VisitScalar returns the children of a scalar-typed node.
+func VisitScalar(node ScalarNode) Nodes { return Children(node) }
+
+// VisitVector returns the children of a vector-typed node.
+func VisitVector(node VectorNode) Nodes { return Children(node) }
+
+// VisitMatrix returns the children of a matrix-typed node.
+func VisitMatrix(node MatrixNode) Nodes { return Children(node) }
+
+// VisitString returns the children of a string-typed node.
+func VisitString(node StringNode) Nodes { return Children(node) }
+
+// inspector adapts a plain func(Node) bool into a Visitor, the same way
+// go/ast.Inspect does for its own tree.
+type inspector func(Node) bool
+
+func (f inspector) Visit(node Node) (Visitor, bool) {
+	if f(node) {
+		return f, true
+	}
+	return nil, false
+}
+
+// Inspect traverses an AST in depth-first order: it calls f(node); if f
+// returns true, Inspect invokes f recursively for each of the children of
+// node. This is a convenience wrapper around Walk for callers (query
+// linters, dependency extractors, rewriters) that only need a callback,
+// not a full Visitor.
+func Inspect(node Node, f func(Node) bool) {
+	Walk(inspector(f), node)
+}